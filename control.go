@@ -0,0 +1,190 @@
+// Program docksock, control API
+package main
+
+/*
+ * control.go
+ * HTTP control API and Prometheus metrics
+ * By J. Stuart McMurray
+ * Created 20190208
+ * Last Modified 20190208
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+)
+
+/* serveControl serves the control API on the next available port.  It
+closes ready when it's ready to serve. */
+func serveControl(w *walker, ready chan<- struct{}) {
+	l, _, err := w.listen("control", "control API")
+	if nil != err {
+		lg.Error("Unable to listen for the control API: %v", err)
+		os.Exit(1)
+	}
+	lg.Info("Listening on %v for the control API", l.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sockets", w.handleSockets)
+	mux.HandleFunc("/rescan", w.handleRescan)
+	mux.HandleFunc("/metrics", w.handleMetrics)
+
+	close(ready)
+
+	if err := http.Serve(l, mux); nil != err {
+		lg.Warn("Control API server stopped: %v", err)
+	}
+}
+
+/* handleSockets handles GET /sockets, returning a JSON list of every
+forwarded socket's current stats, and DELETE /sockets?path=..., which tears
+that socket's forwarder down.  The target path is taken from a query
+parameter rather than the URL path itself because socket paths are
+themselves absolute paths (e.g. /var/run/docker.sock); putting one after
+/sockets/ produces a double slash which http.ServeMux's cleanPath redirects
+away before the handler ever runs. */
+func (w *walker) handleSockets(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.listSockets(rw, r)
+	case http.MethodDelete:
+		w.deleteSocket(rw, r)
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/* listSockets writes a JSON list of every forwarded socket's current
+stats. */
+func (w *walker) listSockets(rw http.ResponseWriter, r *http.Request) {
+	w.statsL.Lock()
+	infos := make([]socketInfo, 0, len(w.stats))
+	for path, st := range w.stats {
+		infos = append(infos, st.info(path))
+	}
+	w.statsL.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Path < infos[j].Path
+	})
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(infos); nil != err {
+		lg.Warn("Error encoding socket list: %v", err)
+	}
+}
+
+/* deleteSocket tears down the forwarder for the socket named by the "path"
+query parameter. */
+func (w *walker) deleteSocket(rw http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if "" == path {
+		http.Error(
+			rw,
+			"missing path query parameter",
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	w.cancelsL.Lock()
+	cancel, ok := w.cancels[path]
+	w.cancelsL.Unlock()
+	if !ok {
+		http.Error(rw, "unknown socket", http.StatusNotFound)
+		return
+	}
+	/* Tombstone path first, so a fallback scan or inotify event racing
+	with cancel's teardown can't re-serve it before the tombstone's in
+	place. */
+	w.removedL.Lock()
+	w.removed[path] = struct{}{}
+	w.removedL.Unlock()
+	cancel()
+
+	lg.Info(
+		"[%v] Forwarder torn down via control API; won't be "+
+			"re-served until the socket itself disappears and "+
+			"comes back",
+		path,
+	)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+/* handleRescan handles POST /rescan, which asks the scanning loop in main
+to walk the filesystem immediately rather than waiting for -scan-interval to
+elapse. */
+func (w *walker) handleRescan(rw http.ResponseWriter, r *http.Request) {
+	if http.MethodPost != r.Method {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case w.rescanCh <- struct{}{}:
+	default: /* A rescan's already pending */
+	}
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+/* handleMetrics handles GET /metrics, exporting per-path counters and
+gauges in Prometheus text format. */
+func (w *walker) handleMetrics(rw http.ResponseWriter, r *http.Request) {
+	if http.MethodGet != r.Method {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	/* Snapshot the counters under the lock, then release it before
+	writing: statsL is a hot-path lock (pump, serve, and forget all take
+	it), and a slow or stalled /metrics client would otherwise hold it
+	for the life of the response. */
+	w.statsL.Lock()
+	infos := make([]socketInfo, 0, len(w.stats))
+	for path, st := range w.stats {
+		infos = append(infos, st.info(path))
+	}
+	w.statsL.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Path < infos[j].Path
+	})
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(rw, "# HELP docksock_bytes_in_total Bytes forwarded "+
+		"from clients into a socket.")
+	fmt.Fprintln(rw, "# TYPE docksock_bytes_in_total counter")
+	for _, info := range infos {
+		fmt.Fprintf(
+			rw,
+			"docksock_bytes_in_total{path=%q} %d\n",
+			info.Path,
+			info.BytesIn,
+		)
+	}
+
+	fmt.Fprintln(rw, "# HELP docksock_bytes_out_total Bytes forwarded "+
+		"from a socket back to clients.")
+	fmt.Fprintln(rw, "# TYPE docksock_bytes_out_total counter")
+	for _, info := range infos {
+		fmt.Fprintf(
+			rw,
+			"docksock_bytes_out_total{path=%q} %d\n",
+			info.Path,
+			info.BytesOut,
+		)
+	}
+
+	fmt.Fprintln(rw, "# HELP docksock_active_connections Currently "+
+		"active proxied connections.")
+	fmt.Fprintln(rw, "# TYPE docksock_active_connections gauge")
+	for _, info := range infos {
+		fmt.Fprintf(
+			rw,
+			"docksock_active_connections{path=%q} %d\n",
+			info.Path,
+			info.ActiveConns,
+		)
+	}
+}
@@ -0,0 +1,162 @@
+// Program docksock, socket discovery
+package main
+
+/*
+ * discover.go
+ * inotify-driven discovery of new and removed sockets
+ * By J. Stuart McMurray
+ * Created 20190208
+ * Last Modified 20190208
+ */
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/* discoverer watches the filesystem with inotify for new and removed unix
+sockets, so walker doesn't need to re-walk the whole tree on a timer to find
+them. */
+type discoverer struct {
+	w  *walker
+	fd int
+
+	dirs  map[int32]string /* watch descriptor -> directory */
+	wds   map[string]int32 /* directory -> watch descriptor */
+	dirsL *sync.Mutex
+}
+
+/* inotifyMask is the set of events discoverer cares about: new entries,
+attribute changes (which is how a freshly-bound socket often appears), and
+removals or renames.  The kernel sends IN_IGNORED whenever a watch stops
+(the watched directory's removed, explicitly rm -rf'd, or unmounted)
+regardless of whether it's in this mask; handle relies on that to prune
+dirs/wds. */
+const inotifyMask = unix.IN_CREATE | unix.IN_ATTRIB | unix.IN_DELETE |
+	unix.IN_MOVED_TO | unix.IN_MOVED_FROM
+
+/* newDiscoverer sets up an inotify instance for w. */
+func newDiscoverer(w *walker) (*discoverer, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if nil != err {
+		return nil, err
+	}
+	return &discoverer{
+		w:     w,
+		fd:    fd,
+		dirs:  make(map[int32]string),
+		wds:   make(map[string]int32),
+		dirsL: new(sync.Mutex),
+	}, nil
+}
+
+/* watch adds an inotify watch for dir, unless it's already watched. */
+func (d *discoverer) watch(dir string) {
+	d.dirsL.Lock()
+	defer d.dirsL.Unlock()
+	if _, ok := d.wds[dir]; ok {
+		return
+	}
+	wd, err := unix.InotifyAddWatch(d.fd, dir, inotifyMask)
+	if nil != err {
+		lg.Debug("scan", "Unable to watch %v: %v", dir, err)
+		return
+	}
+	d.dirs[int32(wd)] = dir
+	d.wds[dir] = int32(wd)
+}
+
+/* forgetWatch removes wd's bookkeeping once the kernel's reported it's no
+longer watching, via IN_IGNORED. */
+func (d *discoverer) forgetWatch(wd int32) {
+	d.dirsL.Lock()
+	defer d.dirsL.Unlock()
+	dir, ok := d.dirs[wd]
+	if !ok {
+		return
+	}
+	delete(d.dirs, wd)
+	delete(d.wds, dir)
+}
+
+/* run reads and handles inotify events until the underlying inotify fd is
+closed or unreadable.  It's meant to be run in its own goroutine. */
+func (d *discoverer) run() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := unix.Read(d.fd, buf)
+		if nil != err {
+			lg.Warn("Error reading inotify events: %v", err)
+			return
+		}
+		var off int
+		for off < n {
+			ev := (*unix.InotifyEvent)(
+				unsafe.Pointer(&buf[off]),
+			)
+			var name string
+			if 0 != ev.Len {
+				nb := buf[off+unix.SizeofInotifyEvent : off+
+					unix.SizeofInotifyEvent+int(ev.Len)]
+				name = strings.TrimRight(
+					string(nb),
+					"\x00",
+				)
+			}
+			d.handle(ev, name)
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+		}
+	}
+}
+
+/* handle acts on a single inotify event for the file called name, in the
+directory watched by ev.Wd. */
+func (d *discoverer) handle(ev *unix.InotifyEvent, name string) {
+	/* The watch itself stopped, e.g. because its directory was removed;
+	forget it so dirs/wds don't grow unbounded and, if the same path's
+	recreated later, watch doesn't mistake the stale entry for a live
+	watch. */
+	if 0 != ev.Mask&unix.IN_IGNORED {
+		d.forgetWatch(ev.Wd)
+		return
+	}
+
+	if "" == name {
+		return
+	}
+	d.dirsL.Lock()
+	dir, ok := d.dirs[ev.Wd]
+	d.dirsL.Unlock()
+	if !ok {
+		return
+	}
+	path := filepath.Join(dir, name)
+
+	/* Something's gone away; tear down its forwarder, if it has one */
+	if 0 != ev.Mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) {
+		d.w.forget(path)
+		return
+	}
+
+	/* Something's new or changed; see if it's a socket or a directory
+	we've not yet got a watch on */
+	info, err := os.Lstat(path)
+	if nil != err {
+		return
+	}
+	if info.IsDir() {
+		if strings.HasPrefix(path, "/proc") ||
+			strings.HasPrefix(path, "/sys") ||
+			strings.HasPrefix(path, "/dev") {
+			return
+		}
+		d.watch(path)
+		return
+	}
+	d.w.maybeServe(path, info)
+}
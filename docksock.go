@@ -10,10 +10,15 @@ package main
  */
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -21,16 +26,24 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/magisterquis/docksock/internal/dlog"
 )
 
 var (
-	/* verbose is the logging function */
-	verbose = func(string, ...interface{}) {}
+	/* lg is the process-wide logger */
+	lg = dlog.New(os.Stderr)
 
 	// ErrNoPortsLeft is returned if there's no more allowed listening
 	// ports
 	ErrNoPortsLeft = errors.New("no more ports")
+
+	// ErrNotAllowed is returned by proxy when a client's verified
+	// identity isn't in the ACL for the socket path it's trying to
+	// reach.
+	ErrNotAllowed = errors.New("client not in acl for this socket")
 )
 
 // CloseWriter is an interface which wraps the CloseWrite method.
@@ -38,18 +51,194 @@ type CloseWriter interface {
 	CloseWrite() error
 }
 
+/* aclEntry maps a regex matching one or more socket paths to the set of
+client CNs/SANs allowed to proxy to them. */
+type aclEntry struct {
+	re      *regexp.Regexp
+	allowed map[string]struct{}
+}
+
+/* allows returns true if name is in e's allowed set. */
+func (e aclEntry) allows(name string) bool {
+	_, ok := e.allowed[name]
+	return ok
+}
+
+/* loadACL reads an ACL file and returns the list of entries in it.  Each
+non-blank, non-comment line has the form
+
+	socket-path-regex cn-or-san[,cn-or-san...]
+
+Lines beginning with # are comments. */
+func loadACL(path string) ([]aclEntry, error) {
+	f, err := os.Open(path)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []aclEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if "" == line || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if 2 != len(fields) {
+			return nil, fmt.Errorf(
+				"invalid acl line %q",
+				line,
+			)
+		}
+		re, err := regexp.Compile(fields[0])
+		if nil != err {
+			return nil, fmt.Errorf(
+				"invalid regex %q: %w",
+				fields[0],
+				err,
+			)
+		}
+		allowed := make(map[string]struct{})
+		for _, n := range strings.Split(fields[1], ",") {
+			n = strings.TrimSpace(n)
+			if "" == n {
+				continue
+			}
+			allowed[n] = struct{}{}
+		}
+		entries = append(entries, aclEntry{re: re, allowed: allowed})
+	}
+	if err := s.Err(); nil != err {
+		return nil, err
+	}
+	return entries, nil
+}
+
+/* sockStat holds the control API's view of a single forwarded socket.  Its
+counters are updated with the atomic package, as they're written from proxy
+goroutines and read from control API handlers concurrently. */
+type sockStat struct {
+	listenAddr  string
+	firstSeen   time.Time
+	bytesIn     uint64 /* Bytes forwarded from clients into the socket */
+	bytesOut    uint64 /* Bytes forwarded from the socket back to clients */
+	activeConns int64
+}
+
+/* socketInfo is sockStat's JSON representation, as returned by GET
+/sockets. */
+type socketInfo struct {
+	Path        string    `json:"path"`
+	ListenAddr  string    `json:"listen_addr"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	ActiveConns int64     `json:"active_conns"`
+	FirstSeen   time.Time `json:"first_seen"`
+}
+
+/* info returns s's current state as a socketInfo for path. */
+func (s *sockStat) info(path string) socketInfo {
+	return socketInfo{
+		Path:        path,
+		ListenAddr:  s.listenAddr,
+		BytesIn:     atomic.LoadUint64(&s.bytesIn),
+		BytesOut:    atomic.LoadUint64(&s.bytesOut),
+		ActiveConns: atomic.LoadInt64(&s.activeConns),
+		FirstSeen:   s.firstSeen,
+	}
+}
+
 /* checker is used to pass a context to filepath.Walk */
 type walker struct {
-	np     uint /* Next port to try to listen on */
-	npL    *sync.Mutex
-	re     *regexp.Regexp /* Regex which sockets must match */
-	slist  string         /* Socket list */
-	slistL *sync.Mutex
-	seen   map[string]struct{} /* Sockets we know about */
-	seenL  *sync.Mutex
+	pool  *PortPool           /* Ports available for listening */
+	re    *regexp.Regexp      /* Regex which sockets must match */
+	seen  map[string]struct{} /* Sockets we know about */
+	seenL *sync.Mutex
+
+	tlsConfig *tls.Config /* Non-nil if listeners require client certs */
+	acl       []aclEntry  /* Per-path client allow-lists */
+
+	stats  map[string]*sockStat /* Per-path stat accumulators */
+	statsL *sync.Mutex
+
+	cancels  map[string]context.CancelFunc /* Per-path forwarder teardown */
+	cancelsL *sync.Mutex
+
+	/* removed is a tombstone set of paths torn down via the control
+	API's DELETE /sockets, so a fallback scan or inotify event for the
+	still-present socket doesn't immediately re-serve it.  A path's
+	tombstone is cleared when the discoverer notices the socket itself
+	has actually gone away, so a later, genuinely new socket at the same
+	path is served normally. */
+	removed  map[string]struct{}
+	removedL *sync.Mutex
+
+	rescanCh chan struct{} /* Poked by POST /rescan */
+
+	disc *discoverer /* Non-nil once inotify watches are set up */
+
+	mode    string /* "port" (default) or "socks" */
+	muxAddr string /* -mode socks's shared listen address */
+}
+
+/* allowed reports whether c, which must have completed a TLS handshake, is
+allowed by w's ACL to reach path.  A client is allowed if its leaf
+certificate's CN, or any of its DNS, email, IP, or URI SANs, is in the
+matching ACL entry's allow-list.  If w has no ACL entries matching path, the
+connection is allowed; this lets operators ACL only the sockets they care
+about. */
+func (w *walker) allowed(path string, c net.Conn) bool {
+	tc, ok := c.(*tls.Conn)
+	if !ok { /* Not TLS; nothing to check against */
+		return true
+	}
+	cs := tc.ConnectionState()
+	if 0 == len(cs.PeerCertificates) {
+		return false
+	}
+	/* Only the leaf cert identifies the client; checking the whole
+	chain would let a CA or intermediate's CN/SAN authorize any client
+	it signed. */
+	leaf := cs.PeerCertificates[0]
+
+	var matched bool
+	for _, e := range w.acl {
+		if !e.re.MatchString(path) {
+			continue
+		}
+		matched = true
+		if e.allows(leaf.Subject.CommonName) {
+			return true
+		}
+		for _, san := range leaf.DNSNames {
+			if e.allows(san) {
+				return true
+			}
+		}
+		for _, san := range leaf.EmailAddresses {
+			if e.allows(san) {
+				return true
+			}
+		}
+		for _, san := range leaf.IPAddresses {
+			if e.allows(san.String()) {
+				return true
+			}
+		}
+		for _, san := range leaf.URIs {
+			if e.allows(san.String()) {
+				return true
+			}
+		}
+	}
+	/* If nothing in the ACL mentions this path, allow it */
+	return !matched
 }
 
-/* walkFn is called for every walked file */
+/* walkFn is called for every walked file.  It's used both for the initial
+bootstrap walk and, in case the event-driven discoverer misses anything, for
+periodic fallback rescans. */
 func (w *walker) walkFn(path string, info os.FileInfo, err error) error {
 	/* Don't care about things we can't access */
 	if nil != err {
@@ -61,96 +250,256 @@ func (w *walker) walkFn(path string, info os.FileInfo, err error) error {
 		strings.HasPrefix(path, "/dev")) {
 		return filepath.SkipDir
 	}
+	/* While we're here, make sure this directory's watched for new and
+	removed sockets */
+	if info.IsDir() {
+		if nil != w.disc {
+			w.disc.watch(path)
+		}
+		return nil
+	}
+
+	w.maybeServe(path, info)
+
+	return nil
+}
 
+/* maybeServe starts serving path if it's a socket matching w's regex and
+isn't already being served. */
+func (w *walker) maybeServe(path string, info os.FileInfo) {
 	/* Make sure it's a socket */
 	if 0 == info.Mode()&os.ModeSocket {
-		return nil
+		return
 	}
 
 	/* Make sure it contains the substring */
 	if !w.re.MatchString(path) {
-		return nil
+		return
+	}
+
+	/* Don't re-serve a socket the control API's torn down on purpose */
+	w.removedL.Lock()
+	_, tombstoned := w.removed[path]
+	w.removedL.Unlock()
+	if tombstoned {
+		return
 	}
 
 	/* If we've already seen this one, don't bother */
 	w.seenL.Lock()
 	if _, ok := w.seen[path]; ok {
 		w.seenL.Unlock()
-		return nil
+		return
 	}
 
 	/* Note that we've seen it now */
 	w.seen[path] = struct{}{}
 	w.seenL.Unlock()
 
-	/* It's a matching socket, serve it */
-	go w.serve(path)
+	/* In -mode socks, every socket shares the one mux listener; there's
+	no per-path forwarder to spawn, just stats to track so the control
+	API and the mux's hostname lookup can find it. */
+	if "socks" == w.mode {
+		w.statsL.Lock()
+		w.stats[path] = &sockStat{
+			listenAddr: w.muxAddr,
+			firstSeen:  time.Now(),
+		}
+		w.statsL.Unlock()
+		return
+	}
 
-	return nil
+	/* It's a matching socket, serve it.  The cancel func lets the
+	control API (DELETE /sockets?path=...) and the discoverer (when the
+	socket itself is removed) tear the forwarder down. */
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancelsL.Lock()
+	w.cancels[path] = cancel
+	w.cancelsL.Unlock()
+	go w.serve(ctx, cancel, path)
 }
 
-/* listen listens on the next port.  It may return ErrNoPortsLeft if there are
-no more ports left for listening. */
-func (w *walker) listen() (net.Listener, error) {
-	var (
-		l   net.Listener
-		err error
-	)
-	/* Find a port on which to listen */
-	for p := w.nextPort(); 0 != p; p = w.nextPort() {
-		a := net.JoinHostPort(
-			net.IPv4zero.String(),
-			fmt.Sprintf("%v", p),
-		)
-		l, err = net.Listen("tcp", a)
+/* forget tears down path's forwarder, if it has one, because the discoverer
+noticed the underlying socket disappeared.  Since the socket itself is
+genuinely gone, any DELETE /sockets tombstone for path is cleared too, so a
+later, different socket bound at the same path is served normally rather
+than silently ignored. */
+func (w *walker) forget(path string) {
+	w.removedL.Lock()
+	delete(w.removed, path)
+	w.removedL.Unlock()
+
+	w.cancelsL.Lock()
+	cancel, ok := w.cancels[path]
+	w.cancelsL.Unlock()
+	if ok {
+		cancel()
+		return
+	}
+	/* No per-path forwarder to cancel, e.g. under -mode socks; just
+	drop path so it can be rediscovered if it reappears */
+	w.seenL.Lock()
+	delete(w.seen, path)
+	w.seenL.Unlock()
+	w.statsL.Lock()
+	delete(w.stats, path)
+	w.statsL.Unlock()
+}
+
+/* listen acquires a port from w.pool and listens on it, retrying with
+another port if the bind itself fails (e.g. something else raced us to it).
+It returns ErrNoPortsLeft if w.pool runs out of ports.  owner is recorded in
+the pool for debugging (typically a socket path); category tags Debug
+logging with the calling subsystem (e.g. "proxy" or "control"). */
+func (w *walker) listen(category, owner string) (net.Listener, uint, error) {
+	/* Ports which failed to bind are held until we're done, so Acquire
+	doesn't hand the same one straight back */
+	var failed []uint
+	defer func() {
+		for _, p := range failed {
+			w.pool.Release(p)
+		}
+	}()
+	for {
+		port, err := w.pool.Acquire(owner)
 		if nil != err {
-			verbose("Cannot listen on %v: %v", a, err)
+			return nil, 0, err
+		}
+		a := net.JoinHostPort(net.IPv4zero.String(), fmt.Sprintf("%v", port))
+		l, err := net.Listen("tcp", a)
+		if nil != err {
+			lg.Debug(category, "Cannot listen on %v: %v", a, err)
+			failed = append(failed, port)
 			continue
 		}
-		return l, nil
+		if nil != w.tlsConfig {
+			l = tls.NewListener(l, w.tlsConfig)
+		}
+		return l, port, nil
 	}
-	/* If we still haven't got a port, bummer */
-	return nil, ErrNoPortsLeft
 }
 
-/* serve proxies tcp connections on the next available port to the socket */
-func (w *walker) serve(path string) {
+/* serve proxies tcp connections on the next available port to the socket at
+path, until ctx is cancelled, either by DELETE /sockets?path=... or because the
+socket itself has gone away.  cancel is ctx's cancel func; serve calls it on
+its way out so the "close the listener on ctx.Done()" goroutine below always
+unwinds, even when serve exits for some other reason (e.g. a non-ctx Accept
+error). */
+func (w *walker) serve(ctx context.Context, cancel context.CancelFunc, path string) {
+	/* Make sure path's forwarder can be found and torn down by path,
+	whatever happens */
+	defer func() {
+		cancel()
+		w.cancelsL.Lock()
+		delete(w.cancels, path)
+		w.cancelsL.Unlock()
+		w.statsL.Lock()
+		delete(w.stats, path)
+		w.statsL.Unlock()
+		w.seenL.Lock()
+		delete(w.seen, path)
+		w.seenL.Unlock()
+	}()
 
 	/* Spawn a listener */
-	l, err := w.listen()
+	l, port, err := w.listen("proxy", path)
 	if nil != err {
-		verbose("[%v] Unable to make listener: %v", path, err)
+		lg.Error("[%v] Unable to make listener: %v", path, err)
 		return
 	}
-	verbose("Listening on %v for connections to %v", l.Addr(), path)
+	lg.Info("Listening on %v for connections to %v", l.Addr(), path)
+	/* Deferred in this order so Release runs after Close: otherwise the
+	port would go back to the pool, and could be Acquired and fail to
+	bind "address already in use", before the old listener's socket was
+	actually closed. */
+	defer w.pool.Release(port)
 	defer l.Close()
 
-	/* Not the listening socket and path */
-	w.slistL.Lock()
-	w.slist += fmt.Sprintf("%v -> %v\n", l.Addr(), path)
-	w.slistL.Unlock()
+	/* Close the listener, which unblocks Accept below, when path's
+	forwarder is torn down */
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	/* Note this path in the control API's stats */
+	w.statsL.Lock()
+	w.stats[path] = &sockStat{
+		listenAddr: l.Addr().String(),
+		firstSeen:  time.Now(),
+	}
+	w.statsL.Unlock()
 
 	/* Accept and serve clients */
 	for {
 		c, err := l.Accept()
 		if nil != err {
-			verbose(
-				"Error accepting connection to %v: %v",
-				l.Addr(),
-				err,
-			)
+			if nil != ctx.Err() {
+				lg.Debug(
+					"proxy",
+					"[%v] Forwarder torn down",
+					path,
+				)
+			} else {
+				lg.Warn(
+					"Error accepting connection to "+
+						"%v: %v",
+					l.Addr(),
+					err,
+				)
+			}
 			break
 		}
-		go w.proxy(c, path)
+		traceID := dlog.NewTraceID()
+		lg.Debug(
+			"proxy",
+			"[%v] Accepted %v for %v",
+			traceID,
+			c.RemoteAddr(),
+			path,
+		)
+		go w.proxy(c, path, traceID)
 	}
 }
 
-/* proxy proxies between c and the unix socket at path */
-func (w *walker) proxy(c net.Conn, path string) {
+/* proxy proxies between c and the unix socket at path, for -mode port's one
+listener per socket.  traceID is a short per-connection identifier which
+prefixes every log line proxy and pump emit for c, so they can be
+correlated with one another. */
+func (w *walker) proxy(c net.Conn, path, traceID string) {
 	defer c.Close()
 
-	tag := fmt.Sprintf("%v -> %v", c.RemoteAddr(), path)
-	verbose("[%v] Connected", tag)
+	tag := fmt.Sprintf("%v %v -> %v", traceID, c.RemoteAddr(), path)
+	lg.Debug("proxy", "[%v] Connected", tag)
+
+	/* If this is a TLS listener, make sure the client's certificate is
+	allowed to reach this socket before dialing it */
+	if tc, ok := c.(*tls.Conn); ok {
+		if err := tc.Handshake(); nil != err {
+			lg.Warn("[%v] TLS handshake failed: %v", tag, err)
+			return
+		}
+		if !w.allowed(path, c) {
+			lg.Warn("[%v] %v", tag, ErrNotAllowed)
+			return
+		}
+	}
+
+	w.pump(c, path, tag)
+}
+
+/* pump dials the unix socket at path and copies bytes between it and c
+until both directions are done, updating path's stat accumulators as it
+goes.  Callers must authenticate and authorize c against path themselves,
+e.g. as proxy does, before calling pump. */
+func (w *walker) pump(c net.Conn, path, tag string) {
+	w.statsL.Lock()
+	stat := w.stats[path]
+	w.statsL.Unlock()
+	if nil != stat {
+		atomic.AddInt64(&stat.activeConns, 1)
+		defer atomic.AddInt64(&stat.activeConns, -1)
+	}
 
 	/* Try to connect to the socket */
 	s, err := net.Dial("unix", path)
@@ -160,7 +509,7 @@ func (w *walker) proxy(c net.Conn, path string) {
 			tag,
 			err,
 		)
-		verbose("%s", m)
+		lg.Warn("%s", m)
 		fmt.Fprintf(c, "%s", m)
 		return
 	}
@@ -180,7 +529,7 @@ func (w *walker) proxy(c net.Conn, path string) {
 		}
 		n, err := io.Copy(c, s)
 		if nil != err && io.EOF != err {
-			verbose(
+			lg.Warn(
 				"[%v] Error sending data to %v: %v",
 				tag,
 				c.RemoteAddr(),
@@ -196,7 +545,7 @@ func (w *walker) proxy(c net.Conn, path string) {
 		}
 		n, err := io.Copy(s, c)
 		if nil != err && io.EOF != err {
-			verbose(
+			lg.Warn(
 				"[%v] Error sending data from %v: %v",
 				tag,
 				path,
@@ -207,51 +556,18 @@ func (w *walker) proxy(c net.Conn, path string) {
 	}()
 	pwg.Wait()
 
-	verbose("[%v] Done.  %v bytes forward, %v bytes back.", tag, fn, rn)
-}
-
-/* nextPort returns the next port in w */
-func (w *walker) nextPort() uint {
-	w.npL.Lock()
-	defer w.npL.Unlock()
-	p := w.np
-	w.np++
-	w.np %= 65536
-	return p
-}
-
-/* serveList serves the list of listening sockets.  It closes ready when it's
-ready to serve */
-func (w *walker) serveList(ready chan<- struct{}) {
-	/* Spawn a listener */
-	l, err := w.listen()
-	if nil != err {
-		verbose("Unable to listen for list queries: %v", err)
-		os.Exit(1)
+	if nil != stat {
+		atomic.AddUint64(&stat.bytesIn, uint64(fn))
+		atomic.AddUint64(&stat.bytesOut, uint64(rn))
 	}
-	verbose("Listening on %v for list queries", l.Addr())
-	defer l.Close()
-	close(ready)
 
-	/* Service queries for lists */
-	for {
-		c, err := l.Accept()
-		if nil != err {
-			verbose("Unable to accept list query client: %v", err)
-			break
-		}
-		go func(lc net.Conn) {
-			defer lc.Close()
-			w.slistL.Lock()
-			s := w.slist
-			if "" == s {
-				s = "none yet\n"
-			}
-			w.slistL.Unlock()
-			fmt.Fprintf(lc, "%s", s)
-			verbose("[%v] List query", lc.RemoteAddr())
-		}(c)
-	}
+	lg.Debug(
+		"proxy",
+		"[%v] Done.  %v bytes forward, %v bytes back.",
+		tag,
+		fn,
+		rn,
+	)
 }
 
 func main() {
@@ -261,10 +577,11 @@ func main() {
 			"ssh|docker|tmux|tmp",
 			"Socket paths must match the `regex` to be served",
 		)
-		startPort = flag.Uint(
-			"start-port",
-			51111,
-			"Starting `port` to use for socket service",
+		portRange = flag.String(
+			"port-range",
+			"51111-51999",
+			"`low-high` ports to use for socket service, "+
+				"inclusive",
 		)
 		startDir = flag.String(
 			"top-dir",
@@ -274,12 +591,47 @@ func main() {
 		logOn = flag.Bool(
 			"v",
 			false,
-			"Verbose logging",
+			"Also log informational messages "+
+				"(warnings and errors are always logged)",
+		)
+		logJSON = flag.Bool(
+			"log-json",
+			false,
+			"Log in JSON instead of plain text",
 		)
 		scanInterval = flag.Duration(
 			"scan-interval",
 			5*time.Minute,
-			"Time to `wait` between scans for new sockets",
+			"Time to `wait` between fallback scans for new "+
+				"sockets, in case an inotify event is missed",
+		)
+		tlsCert = flag.String(
+			"tls-cert",
+			"",
+			"TLS certificate `file`, to require client certs",
+		)
+		tlsKey = flag.String(
+			"tls-key",
+			"",
+			"TLS key `file`, paired with -tls-cert",
+		)
+		tlsClientCA = flag.String(
+			"tls-client-ca",
+			"",
+			"Client CA `file`, used to verify client certs",
+		)
+		aclFile = flag.String(
+			"acl-file",
+			"",
+			"Optional `file` mapping socket-path regexes to "+
+				"allowed client CNs/SANs",
+		)
+		mode = flag.String(
+			"mode",
+			"port",
+			"Proxy `mode`: \"port\" for one TCP port per "+
+				"socket, or \"socks\" for a single "+
+				"SOCKS5/HTTP CONNECT multiplexer port",
 		)
 	)
 	flag.Usage = func() {
@@ -288,11 +640,24 @@ func main() {
 			`Usage: %v [options]
 
 Finds unix sockets matching a regex and for each found socket, listens on a TCP
-port and forwards connections to the Unix socket.  Every so often the
-filesystem is scanned for new sockets.
+port and forwards connections to the Unix socket.  After an initial scan of
+the filesystem, new and removed sockets are noticed via inotify, with a
+periodic fallback scan in case an event's missed.
+
+The first port serves the control API: GET /sockets for a JSON list of
+forwarded sockets, POST /rescan to scan for new sockets immediately, DELETE
+/sockets?path=... to tear a forwarder down, and GET /metrics for Prometheus
+metrics.  A socket torn down with DELETE stays torn down across fallback
+scans and inotify events until the socket itself is removed and a new one
+appears at the same path.
+
+In -mode socks, one additional port speaks SOCKS5 and HTTP CONNECT; the
+"hostname" a client asks to connect to is looked up against known sockets by
+full path, base name (e.g. docker.sock), or short hash name.
 
-The first port will send a list of port -> socket mappings to any connecting
-client.
+Set the environment variable DOCKSOCK_TRACE to a comma-separated list of
+categories (scan, proxy, control) to enable Debug-level logging for them,
+e.g. DOCKSOCK_TRACE=scan,proxy.
 
 Options:
 `,
@@ -302,37 +667,134 @@ Options:
 	}
 	flag.Parse()
 
-	/* Disable logging, maybe */
+	/* Turn up logging, maybe */
 	if *logOn {
-		log.SetOutput(os.Stdout)
-		verbose = log.Printf
+		lg.SetLevel(dlog.LevelInfo)
+	}
+	if *logJSON {
+		lg.SetJSON(true)
+	}
+
+	if "port" != *mode && "socks" != *mode {
+		log.Fatalf("-mode must be one of \"port\" or \"socks\"")
+	}
+
+	low, high, err := parsePortRange(*portRange)
+	if nil != err {
+		log.Fatalf("Invalid -port-range %q: %v", *portRange, err)
+	}
+	pool, err := NewPortPool(low, high)
+	if nil != err {
+		log.Fatalf("Error setting up port pool: %v", err)
 	}
 
 	/* Walk context */
 	w := &walker{
-		np:     *startPort,
-		npL:    new(sync.Mutex),
-		slistL: new(sync.Mutex),
-		seen:   make(map[string]struct{}),
-		seenL:  new(sync.Mutex),
+		pool:     pool,
+		seen:     make(map[string]struct{}),
+		seenL:    new(sync.Mutex),
+		stats:    make(map[string]*sockStat),
+		statsL:   new(sync.Mutex),
+		cancels:  make(map[string]context.CancelFunc),
+		cancelsL: new(sync.Mutex),
+		removed:  make(map[string]struct{}),
+		removedL: new(sync.Mutex),
+		rescanCh: make(chan struct{}, 1),
+		mode:     *mode,
 	}
-	var err error
 	w.re, err = regexp.Compile(*re)
 	if nil != err {
-		verbose("Error compiling regex: %v", err)
+		lg.Error("Error compiling regex: %v", err)
 	}
 
-	/* Serve up a list of sockets */
+	/* Set up mTLS, if requested */
+	if "" != *tlsCert || "" != *tlsKey || "" != *tlsClientCA {
+		if "" == *tlsCert || "" == *tlsKey || "" == *tlsClientCA {
+			log.Fatalf(
+				"-tls-cert, -tls-key, and -tls-client-ca " +
+					"must all be set together",
+			)
+		}
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if nil != err {
+			log.Fatalf("Error loading TLS keypair: %v", err)
+		}
+		caPEM, err := ioutil.ReadFile(*tlsClientCA)
+		if nil != err {
+			log.Fatalf("Error reading client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			log.Fatalf(
+				"No certificates found in %v",
+				*tlsClientCA,
+			)
+		}
+		w.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		}
+	}
+	if "" != *aclFile {
+		if nil == w.tlsConfig {
+			log.Fatalf(
+				"-acl-file requires -tls-cert, -tls-key, and " +
+					"-tls-client-ca; without client " +
+					"certs there's no verified identity " +
+					"to check the ACL against",
+			)
+		}
+		w.acl, err = loadACL(*aclFile)
+		if nil != err {
+			log.Fatalf("Error loading ACL file: %v", err)
+		}
+	}
+
+	/* Serve the control API (GET /sockets, POST /rescan, DELETE
+	/sockets?path=..., GET /metrics) */
 	ready := make(chan struct{})
-	go w.serveList(ready)
+	go serveControl(w, ready)
 	<-ready
 
-	/* Look for sockets every so often */
+	/* In -mode socks, start the single SOCKS5/CONNECT mux port before
+	walking the tree, so w.muxAddr is set before any socket's added to
+	w.stats */
+	if "socks" == w.mode {
+		muxReady := make(chan struct{})
+		go serveMux(w, muxReady)
+		<-muxReady
+	}
+
+	/* Set up inotify watches on every directory as we bootstrap-walk
+	the tree, so new and removed sockets are noticed in milliseconds
+	rather than waiting for the next scan */
+	disc, err := newDiscoverer(w)
+	if nil != err {
+		log.Fatalf("Error setting up socket discovery: %v", err)
+	}
+	w.disc = disc
+
+	lg.Debug("scan", "Bootstrap scan of %v", *startDir)
+	if err := filepath.Walk(*startDir, w.walkFn); nil != err {
+		log.Fatalf("Error walking file tree: %v", err)
+	}
+	go disc.run()
+
+	/* The scan interval is now just a fallback, in case an inotify
+	event's missed (e.g. the watch limit's hit), or to pick up sockets
+	under a directory created before docksock started watching it.  A
+	client POSTing to /rescan forces one immediately. */
 	for {
+		select {
+		case <-time.After(*scanInterval):
+			lg.Debug("scan", "Fallback scan of %v", *startDir)
+		case <-w.rescanCh:
+			lg.Debug("scan", "Rescan requested via control API")
+		}
 		if err := filepath.Walk(*startDir, w.walkFn); nil != err {
-			log.Fatalf("Error walking file tree: %v", err)
+			lg.Warn("Error walking file tree: %v", err)
 		}
-		time.Sleep(*scanInterval)
 	}
 
 }
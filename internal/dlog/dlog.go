@@ -0,0 +1,208 @@
+// Package dlog provides small leveled, category-gated logging for docksock.
+package dlog
+
+/*
+ * dlog.go
+ * Leveled logging with optional JSON output and per-category tracing
+ * By J. Stuart McMurray
+ * Created 20190208
+ * Last Modified 20190208
+ */
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level indicates the severity of a log message.
+type Level int
+
+// Log levels, in increasing order of severity.  Debug messages are gated by
+// category rather than by Level; see Logger.Debug.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String implements fmt.Stringer.
+func (lv Level) String() string {
+	switch lv {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// EnvTraceVar is the environment variable read by New to enable Debug
+// categories, e.g. DOCKSOCK_TRACE=scan,proxy,control
+const EnvTraceVar = "DOCKSOCK_TRACE"
+
+// Logger is a small leveled logger.  Debug messages are further gated by
+// category; a category is only logged if it's been enabled with Enable or
+// via the DOCKSOCK_TRACE environment variable.
+type Logger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	json  bool
+	level Level
+	cats  map[string]struct{} /* Enabled debug categories */
+}
+
+// New returns a new Logger which writes to out at LevelWarn, with Debug
+// categories enabled per the DOCKSOCK_TRACE environment variable.
+func New(out io.Writer) *Logger {
+	l := &Logger{
+		out:   out,
+		level: LevelWarn,
+		cats:  make(map[string]struct{}),
+	}
+	for _, c := range strings.Split(os.Getenv(EnvTraceVar), ",") {
+		c = strings.TrimSpace(c)
+		if "" != c {
+			l.cats[c] = struct{}{}
+		}
+	}
+	return l
+}
+
+// SetJSON turns JSON-formatted output on or off.
+func (l *Logger) SetJSON(on bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.json = on
+}
+
+// SetLevel sets the minimum level which'll be logged for Info/Warn/Error
+// messages.  Debug messages are gated by category instead; see Enable.
+func (l *Logger) SetLevel(lv Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = lv
+}
+
+// Enable turns on Debug logging for category.
+func (l *Logger) Enable(category string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cats[category] = struct{}{}
+}
+
+// Enabled returns true if category has been enabled for Debug logging.
+func (l *Logger) Enabled(category string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.cats[category]
+	return ok
+}
+
+// Debug logs a message at LevelDebug, tagged with category.  It's a no-op
+// unless category has been enabled, either with Enable or via
+// DOCKSOCK_TRACE.
+func (l *Logger) Debug(category, format string, a ...interface{}) {
+	if !l.Enabled(category) {
+		return
+	}
+	l.log(LevelDebug, category, format, a...)
+}
+
+// Info logs a message at LevelInfo.
+func (l *Logger) Info(format string, a ...interface{}) {
+	l.logIfAbove(LevelInfo, format, a...)
+}
+
+// Warn logs a message at LevelWarn.
+func (l *Logger) Warn(format string, a ...interface{}) {
+	l.logIfAbove(LevelWarn, format, a...)
+}
+
+// Error logs a message at LevelError.
+func (l *Logger) Error(format string, a ...interface{}) {
+	l.logIfAbove(LevelError, format, a...)
+}
+
+/* logIfAbove logs at lv unless lv is below the Logger's configured level. */
+func (l *Logger) logIfAbove(lv Level, format string, a ...interface{}) {
+	l.mu.Lock()
+	cur := l.level
+	l.mu.Unlock()
+	if lv < cur {
+		return
+	}
+	l.log(lv, "", format, a...)
+}
+
+/* logLine is the JSON shape emitted when JSON output is on. */
+type logLine struct {
+	Time     string `json:"time"`
+	Level    string `json:"level"`
+	Category string `json:"category,omitempty"`
+	Message  string `json:"message"`
+}
+
+/* log writes a single log line, in text or JSON form as configured. */
+func (l *Logger) log(lv Level, category, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.json {
+		b, err := json.Marshal(logLine{
+			Time:     now.Format(time.RFC3339Nano),
+			Level:    lv.String(),
+			Category: category,
+			Message:  msg,
+		})
+		if nil != err { /* Shouldn't happen */
+			fmt.Fprintf(
+				l.out,
+				"Error marshalling log line: %v\n",
+				err,
+			)
+			return
+		}
+		fmt.Fprintf(l.out, "%s\n", b)
+		return
+	}
+
+	if "" != category {
+		fmt.Fprintf(
+			l.out,
+			"%v %v [%v] %v\n",
+			now.Format(time.RFC3339),
+			lv,
+			category,
+			msg,
+		)
+		return
+	}
+	fmt.Fprintf(l.out, "%v %v %v\n", now.Format(time.RFC3339), lv, msg)
+}
+
+// NewTraceID returns a short random hex string suitable for correlating log
+// lines which belong to a single connection.
+func NewTraceID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); nil != err {
+		/* Logging shouldn't be able to panic the program */
+		return "------"
+	}
+	return hex.EncodeToString(b)
+}
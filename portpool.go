@@ -0,0 +1,89 @@
+// Program docksock, port allocation
+package main
+
+/*
+ * portpool.go
+ * Port allocation with an explicit range and reuse
+ * By J. Stuart McMurray
+ * Created 20190208
+ * Last Modified 20190208
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PortPool hands out TCP ports from a fixed range, with Release putting a
+// port back for reuse once its forwarder's torn down.  This avoids leaking
+// ports across rescans the way a monotonically-increasing counter would.
+type PortPool struct {
+	mu   sync.Mutex
+	free []uint
+	used map[uint]string /* port -> whatever's using it, for debugging */
+}
+
+// NewPortPool returns a PortPool covering every port from low to high,
+// inclusive.
+func NewPortPool(low, high uint) (*PortPool, error) {
+	if high < low {
+		return nil, fmt.Errorf(
+			"high port %v is below low port %v",
+			high,
+			low,
+		)
+	}
+	/* Acquire pops from the end of free, so fill it high to low to hand
+	out the lowest ports first */
+	free := make([]uint, 0, high-low+1)
+	for p := high + 1; p > low; p-- {
+		free = append(free, p-1)
+	}
+	return &PortPool{free: free, used: make(map[uint]string)}, nil
+}
+
+// Acquire returns the next free port in p, noting owner (typically a socket
+// path) as what it's being used for.  It returns ErrNoPortsLeft if p has no
+// free ports.
+func (p *PortPool) Acquire(owner string) (uint, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if 0 == len(p.free) {
+		return 0, ErrNoPortsLeft
+	}
+	port := p.free[len(p.free)-1]
+	p.free = p.free[:len(p.free)-1]
+	p.used[port] = owner
+	return port, nil
+}
+
+// Release returns port to p's free list, making it available for reuse.
+// It's a no-op if port isn't currently acquired.
+func (p *PortPool) Release(port uint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.used[port]; !ok {
+		return
+	}
+	delete(p.used, port)
+	p.free = append(p.free, port)
+}
+
+/* parsePortRange parses s, of the form "low-high", into its two uints. */
+func parsePortRange(s string) (low, high uint, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if 2 != len(parts) {
+		return 0, 0, fmt.Errorf("expected the form low-high")
+	}
+	l, err := strconv.ParseUint(parts[0], 10, 16)
+	if nil != err {
+		return 0, 0, fmt.Errorf("invalid low port: %w", err)
+	}
+	h, err := strconv.ParseUint(parts[1], 10, 16)
+	if nil != err {
+		return 0, 0, fmt.Errorf("invalid high port: %w", err)
+	}
+	return uint(l), uint(h), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+/*
+ * portpool_test.go
+ * Tests for port allocation
+ * By J. Stuart McMurray
+ * Created 20260727
+ * Last Modified 20260727
+ */
+
+import "testing"
+
+func TestParsePortRange(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		s       string
+		wantLow uint
+		wantHi  uint
+		wantErr bool
+	}{
+		{name: "valid", s: "1024-2048", wantLow: 1024, wantHi: 2048},
+		{name: "single port", s: "80-80", wantLow: 80, wantHi: 80},
+		{name: "no dash", s: "1024", wantErr: true},
+		{name: "too many dashes", s: "1-2-3", wantErr: true},
+		{name: "non-numeric low", s: "x-2048", wantErr: true},
+		{name: "non-numeric high", s: "1024-x", wantErr: true},
+		{name: "low out of range", s: "99999-100000", wantErr: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			low, high, err := parsePortRange(c.s)
+			if c.wantErr {
+				if nil == err {
+					t.Fatalf("parsePortRange(%q) got nil error, want one", c.s)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("parsePortRange(%q) unexpected error: %v", c.s, err)
+			}
+			if low != c.wantLow || high != c.wantHi {
+				t.Fatalf(
+					"parsePortRange(%q) = %v, %v; want %v, %v",
+					c.s, low, high, c.wantLow, c.wantHi,
+				)
+			}
+		})
+	}
+}
+
+func TestPortPoolAcquireRelease(t *testing.T) {
+	p, err := NewPortPool(5000, 5002)
+	if nil != err {
+		t.Fatalf("NewPortPool: %v", err)
+	}
+
+	seen := make(map[uint]struct{})
+	for i := 0; i < 3; i++ {
+		port, err := p.Acquire("test")
+		if nil != err {
+			t.Fatalf("Acquire %d: %v", i, err)
+		}
+		if port < 5000 || port > 5002 {
+			t.Fatalf("Acquire returned out-of-range port %v", port)
+		}
+		if _, ok := seen[port]; ok {
+			t.Fatalf("Acquire returned duplicate port %v", port)
+		}
+		seen[port] = struct{}{}
+	}
+
+	if _, err := p.Acquire("test"); ErrNoPortsLeft != err {
+		t.Fatalf("Acquire on empty pool = %v, want ErrNoPortsLeft", err)
+	}
+
+	var freed uint
+	for port := range seen {
+		freed = port
+		break
+	}
+	p.Release(freed)
+
+	reacquired, err := p.Acquire("test2")
+	if nil != err {
+		t.Fatalf("Acquire after Release: %v", err)
+	}
+	if freed != reacquired {
+		t.Fatalf("Acquire after Release = %v, want %v", reacquired, freed)
+	}
+
+	/* Releasing a port not currently acquired is a no-op */
+	p.Release(9999)
+	if _, err := p.Acquire("test3"); ErrNoPortsLeft != err {
+		t.Fatalf(
+			"Acquire after no-op Release = %v, want ErrNoPortsLeft",
+			err,
+		)
+	}
+}
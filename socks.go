@@ -0,0 +1,267 @@
+// Program docksock, SOCKS5/HTTP CONNECT multiplexer
+package main
+
+/*
+ * socks.go
+ * -mode socks: one port, many sockets, via SOCKS5 or HTTP CONNECT
+ * By J. Stuart McMurray
+ * Created 20190208
+ * Last Modified 20190208
+ */
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/magisterquis/docksock/internal/dlog"
+)
+
+/* SOCKS5 protocol bits we care about; docksock only ever speaks just enough
+SOCKS5 to CONNECT to a domain name. */
+const (
+	socks5Version = 0x05
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+
+	socks5RepSucceeded           = 0x00
+	socks5RepHostUnreachable     = 0x04
+	socks5RepCommandNotSupported = 0x07
+)
+
+/* bufConn is a net.Conn whose Read is satisfied from a bufio.Reader wrapping
+the same underlying connection, so bytes buffered while parsing a
+SOCKS5/CONNECT handshake aren't lost once the connection's handed to pump. */
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements io.Reader by reading from bc's bufio.Reader.
+func (bc *bufConn) Read(p []byte) (int, error) { return bc.r.Read(p) }
+
+/* resolveTarget maps name, as given by a SOCKS5 or HTTP CONNECT client, to
+one of w's known socket paths.  name may be a socket's full path, its base
+name (e.g. docker.sock), or the short name returned by hashName. */
+func (w *walker) resolveTarget(name string) (string, bool) {
+	w.seenL.Lock()
+	defer w.seenL.Unlock()
+	if _, ok := w.seen[name]; ok {
+		return name, true
+	}
+	for path := range w.seen {
+		if filepath.Base(path) == name || hashName(path) == name {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+/* hashName returns a short, stable name for path, for use as a SOCKS5 or
+CONNECT target when the path itself or its base name isn't convenient,
+e.g. because two sockets share a base name. */
+func hashName(path string) string {
+	h := sha1.Sum([]byte(path))
+	return hex.EncodeToString(h[:6])
+}
+
+/* serveMux listens on a single port and speaks both SOCKS5 and HTTP CONNECT,
+looking the requested hostname up against w.seen to pick which unix socket
+to bridge a connection to.  It sets w.muxAddr and closes ready once it's
+listening. */
+func serveMux(w *walker, ready chan<- struct{}) {
+	l, _, err := w.listen("proxy", "socks/connect mux")
+	if nil != err {
+		lg.Error("Unable to listen for the SOCKS5/CONNECT mux: %v", err)
+		os.Exit(1)
+	}
+	lg.Info("Listening on %v for SOCKS5/CONNECT clients", l.Addr())
+	w.muxAddr = l.Addr().String()
+	close(ready)
+
+	for {
+		c, err := l.Accept()
+		if nil != err {
+			lg.Warn("Error accepting mux connection: %v", err)
+			break
+		}
+		go w.handleMux(c)
+	}
+}
+
+/* handleMux accepts c, which may speak SOCKS5 or HTTP CONNECT, completes
+its TLS handshake if w requires one, then peeks its first byte to tell the
+two protocols apart and dispatches to the right handler. */
+func (w *walker) handleMux(c net.Conn) {
+	defer c.Close()
+
+	traceID := dlog.NewTraceID()
+	if tc, ok := c.(*tls.Conn); ok {
+		if err := tc.Handshake(); nil != err {
+			lg.Warn("[%v] TLS handshake failed: %v", traceID, err)
+			return
+		}
+	}
+
+	br := bufio.NewReader(c)
+	b, err := br.Peek(1)
+	if nil != err {
+		lg.Debug(
+			"proxy",
+			"[%v] Error peeking mux client: %v",
+			traceID,
+			err,
+		)
+		return
+	}
+	bc := &bufConn{Conn: c, r: br}
+
+	if socks5Version == b[0] {
+		w.handleSOCKS5(c, bc, traceID)
+		return
+	}
+	w.handleConnect(c, bc, traceID)
+}
+
+/* handleSOCKS5 speaks just enough of the SOCKS5 protocol (RFC 1928) to
+negotiate no-auth and a CONNECT to a domain name, then hands the connection
+off to pump.  raw is used to check TLS client identity against path's ACL
+and to write SOCKS5 replies; bc is used for all reads, since it's already
+buffered past the handshake, and is what's handed to pump. */
+func (w *walker) handleSOCKS5(raw net.Conn, bc *bufConn, traceID string) {
+	br := bc.r
+
+	/* Method negotiation: VER(peeked) NMETHODS METHODS... */
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); nil != err {
+		lg.Debug("proxy", "[%v] Bad SOCKS5 greeting: %v", traceID, err)
+		return
+	}
+	if _, err := io.ReadFull(br, make([]byte, hdr[1])); nil != err {
+		lg.Debug("proxy", "[%v] Bad SOCKS5 methods: %v", traceID, err)
+		return
+	}
+	if _, err := raw.Write([]byte{socks5Version, 0x00}); nil != err {
+		return
+	}
+
+	/* Request: VER CMD RSV ATYP */
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); nil != err {
+		lg.Debug("proxy", "[%v] Bad SOCKS5 request: %v", traceID, err)
+		return
+	}
+	if socks5CmdConnect != req[1] {
+		w.socks5Reply(raw, socks5RepCommandNotSupported)
+		return
+	}
+	if socks5AtypDomain != req[3] {
+		lg.Debug(
+			"proxy",
+			"[%v] SOCKS5 request wasn't for a domain name",
+			traceID,
+		)
+		w.socks5Reply(raw, socks5RepCommandNotSupported)
+		return
+	}
+
+	/* DST.ADDR is a length-prefixed domain name; DST.PORT follows but
+	is meaningless here, since the target's always a unix socket */
+	nameLen := make([]byte, 1)
+	if _, err := io.ReadFull(br, nameLen); nil != err {
+		return
+	}
+	name := make([]byte, nameLen[0])
+	if _, err := io.ReadFull(br, name); nil != err {
+		return
+	}
+	if _, err := io.ReadFull(br, make([]byte, 2)); nil != err {
+		return
+	}
+
+	path, ok := w.resolveTarget(string(name))
+	if !ok {
+		lg.Warn("[%v] No known socket matches %q", traceID, name)
+		w.socks5Reply(raw, socks5RepHostUnreachable)
+		return
+	}
+	if !w.allowed(path, raw) {
+		lg.Warn("[%v] %v for %v", traceID, ErrNotAllowed, path)
+		w.socks5Reply(raw, socks5RepHostUnreachable)
+		return
+	}
+	if err := w.socks5Reply(raw, socks5RepSucceeded); nil != err {
+		return
+	}
+
+	tag := fmt.Sprintf("%v %v -> %v", traceID, raw.RemoteAddr(), path)
+	lg.Debug("proxy", "[%v] SOCKS5 connected", tag)
+	w.pump(bc, path, tag)
+}
+
+/* socks5Reply sends a SOCKS5 reply with the given REP code and a null
+BND.ADDR/BND.PORT, as docksock never actually binds a port on the client's
+behalf. */
+func (w *walker) socks5Reply(c net.Conn, rep byte) error {
+	_, err := c.Write([]byte{
+		socks5Version, rep, 0x00, socks5AtypIPv4,
+		0, 0, 0, 0, /* BND.ADDR */
+		0, 0, /* BND.PORT */
+	})
+	return err
+}
+
+/* handleConnect speaks HTTP CONNECT (as used by curl -x and docker -H with
+an HTTP_PROXY set) and, like handleSOCKS5, hands the connection off to pump
+once a target socket's been resolved and authorized. */
+func (w *walker) handleConnect(raw net.Conn, bc *bufConn, traceID string) {
+	req, err := http.ReadRequest(bc.r)
+	if nil != err {
+		lg.Debug("proxy", "[%v] Bad CONNECT request: %v", traceID, err)
+		return
+	}
+	if http.MethodConnect != req.Method {
+		fmt.Fprintf(raw, "HTTP/1.1 400 Bad Request\r\n\r\n")
+		return
+	}
+
+	host := req.Host
+	if "" == host {
+		host = req.URL.Host
+	}
+	if h, _, err := net.SplitHostPort(host); nil == err {
+		host = h
+	}
+
+	path, ok := w.resolveTarget(host)
+	if !ok {
+		lg.Warn("[%v] No known socket matches %q", traceID, host)
+		fmt.Fprintf(raw, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	if !w.allowed(path, raw) {
+		lg.Warn("[%v] %v for %v", traceID, ErrNotAllowed, path)
+		fmt.Fprintf(raw, "HTTP/1.1 403 Forbidden\r\n\r\n")
+		return
+	}
+	if _, err := fmt.Fprintf(
+		raw,
+		"HTTP/1.1 200 Connection Established\r\n\r\n",
+	); nil != err {
+		return
+	}
+
+	tag := fmt.Sprintf("%v %v -> %v", traceID, raw.RemoteAddr(), path)
+	lg.Debug("proxy", "[%v] CONNECT established", tag)
+	w.pump(bc, path, tag)
+}
@@ -0,0 +1,250 @@
+package main
+
+/*
+ * socks_test.go
+ * Tests for the SOCKS5/HTTP CONNECT multiplexer
+ * By J. Stuart McMurray
+ * Created 20260727
+ * Last Modified 20260727
+ */
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestResolveTarget(t *testing.T) {
+	w := &walker{
+		seen: map[string]struct{}{
+			"/var/run/docker.sock": {},
+			"/tmp/other.sock":      {},
+		},
+		seenL: new(sync.Mutex),
+	}
+
+	for _, c := range []struct {
+		name     string
+		query    string
+		wantPath string
+		wantOK   bool
+	}{
+		{
+			name:     "full path",
+			query:    "/var/run/docker.sock",
+			wantPath: "/var/run/docker.sock",
+			wantOK:   true,
+		},
+		{
+			name:     "base name",
+			query:    "docker.sock",
+			wantPath: "/var/run/docker.sock",
+			wantOK:   true,
+		},
+		{
+			name:     "hash name",
+			query:    hashName("/tmp/other.sock"),
+			wantPath: "/tmp/other.sock",
+			wantOK:   true,
+		},
+		{name: "unknown", query: "nope.sock", wantOK: false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path, ok := w.resolveTarget(c.query)
+			if ok != c.wantOK {
+				t.Fatalf(
+					"resolveTarget(%q) ok = %v, want %v",
+					c.query, ok, c.wantOK,
+				)
+			}
+			if ok && path != c.wantPath {
+				t.Fatalf(
+					"resolveTarget(%q) = %q, want %q",
+					c.query, path, c.wantPath,
+				)
+			}
+		})
+	}
+}
+
+/* echoUnixSocket starts a unix socket listener at path which accepts a
+single connection, reads whatever's sent on it, and echoes it back verbatim.
+It's used to stand in for a docker-style socket on the other end of pump. */
+func echoUnixSocket(t *testing.T, path string) {
+	t.Helper()
+	l, err := net.Listen("unix", path)
+	if nil != err {
+		t.Fatalf("listening on %v: %v", path, err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		c, err := l.Accept()
+		if nil != err {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+}
+
+func TestHandleSOCKS5(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "docker.sock")
+	echoUnixSocket(t, path)
+
+	w := &walker{
+		seen:   map[string]struct{}{path: {}},
+		seenL:  new(sync.Mutex),
+		stats:  map[string]*sockStat{path: {}},
+		statsL: new(sync.Mutex),
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	bc := &bufConn{Conn: server, r: bufio.NewReader(server)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.handleSOCKS5(server, bc, "test")
+	}()
+
+	/* Method negotiation: no-auth only */
+	if _, err := client.Write([]byte{socks5Version, 1, 0}); nil != err {
+		t.Fatalf("writing greeting: %v", err)
+	}
+	methodReply := make([]byte, 2)
+	if _, err := io.ReadFull(client, methodReply); nil != err {
+		t.Fatalf("reading method reply: %v", err)
+	}
+	if want := []byte{socks5Version, 0x00}; string(methodReply) != string(want) {
+		t.Fatalf("method reply = %v, want %v", methodReply, want)
+	}
+
+	/* CONNECT request to the socket's base name */
+	name := []byte(filepath.Base(path))
+	req := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AtypDomain}
+	req = append(req, byte(len(name)))
+	req = append(req, name...)
+	req = append(req, 0, 0) /* DST.PORT, unused */
+	if _, err := client.Write(req); nil != err {
+		t.Fatalf("writing request: %v", err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); nil != err {
+		t.Fatalf("reading request reply: %v", err)
+	}
+	if socks5RepSucceeded != reply[1] {
+		t.Fatalf("request reply REP = %#x, want success", reply[1])
+	}
+
+	/* The connection should now be pumped through to the echo socket */
+	if _, err := client.Write([]byte("ping")); nil != err {
+		t.Fatalf("writing payload: %v", err)
+	}
+	echoed := make([]byte, 4)
+	if _, err := io.ReadFull(client, echoed); nil != err {
+		t.Fatalf("reading echo: %v", err)
+	}
+	if "ping" != string(echoed) {
+		t.Fatalf("echoed = %q, want %q", echoed, "ping")
+	}
+
+	client.Close()
+	<-done
+}
+
+func TestHandleSOCKS5UnknownTarget(t *testing.T) {
+	w := &walker{
+		seen:  map[string]struct{}{},
+		seenL: new(sync.Mutex),
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	bc := &bufConn{Conn: server, r: bufio.NewReader(server)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.handleSOCKS5(server, bc, "test")
+	}()
+
+	client.Write([]byte{socks5Version, 1, 0})
+	io.ReadFull(client, make([]byte, 2))
+
+	name := []byte("nope.sock")
+	req := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AtypDomain}
+	req = append(req, byte(len(name)))
+	req = append(req, name...)
+	req = append(req, 0, 0)
+	client.Write(req)
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); nil != err {
+		t.Fatalf("reading reply: %v", err)
+	}
+	if socks5RepHostUnreachable != reply[1] {
+		t.Fatalf(
+			"reply REP = %#x, want host-unreachable",
+			reply[1],
+		)
+	}
+
+	client.Close()
+	<-done
+}
+
+func TestHandleConnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "docker.sock")
+	echoUnixSocket(t, path)
+
+	w := &walker{
+		seen:   map[string]struct{}{path: {}},
+		seenL:  new(sync.Mutex),
+		stats:  map[string]*sockStat{path: {}},
+		statsL: new(sync.Mutex),
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	bc := &bufConn{Conn: server, r: bufio.NewReader(server)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.handleConnect(server, bc, "test")
+	}()
+
+	name := filepath.Base(path)
+	req := "CONNECT " + name + ":0 HTTP/1.1\r\nHost: " + name + "\r\n\r\n"
+	if _, err := client.Write([]byte(req)); nil != err {
+		t.Fatalf("writing CONNECT request: %v", err)
+	}
+
+	br := bufio.NewReader(client)
+	line, err := br.ReadString('\n')
+	if nil != err {
+		t.Fatalf("reading response status line: %v", err)
+	}
+	if "HTTP/1.1 200 Connection Established\r\n" != line {
+		t.Fatalf("status line = %q, want 200 Connection Established", line)
+	}
+	/* Drain the blank line ending the (header-less) response */
+	if _, err := br.ReadString('\n'); nil != err {
+		t.Fatalf("reading blank line: %v", err)
+	}
+
+	if _, err := client.Write([]byte("ping")); nil != err {
+		t.Fatalf("writing payload: %v", err)
+	}
+	echoed := make([]byte, 4)
+	if _, err := io.ReadFull(br, echoed); nil != err {
+		t.Fatalf("reading echo: %v", err)
+	}
+	if "ping" != string(echoed) {
+		t.Fatalf("echoed = %q, want %q", echoed, "ping")
+	}
+
+	client.Close()
+	<-done
+}